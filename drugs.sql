@@ -3,6 +3,16 @@ CREATE TABLE ATCTree
 	Tree NVARCHAR(MAX) NOT NULL
 );
 
+CREATE TABLE ATCNodes
+(
+	ID INT NOT NULL PRIMARY KEY,
+	ParentID INT,
+	Name NVARCHAR(255) NOT NULL,
+	Code NVARCHAR(15),
+	Level INT NOT NULL,
+	Link NVARCHAR(255)
+);
+
 CREATE TABLE Drugs
 (
 	Name NVARCHAR(127) NOT NULL,
@@ -13,5 +23,17 @@ CREATE TABLE Drugs
 	PharmGroup NVARCHAR(255),
 	Registration NVARCHAR(127),
 	ATCCode NVARCHAR(1023),
-	Instruction NVARCHAR(MAX)
+	Instruction NVARCHAR(MAX),
+	Price NVARCHAR(63),
+	Available BIT NOT NULL DEFAULT 0,
+	Form NVARCHAR(255),
+	Package NVARCHAR(255),
+	Storage NVARCHAR(1023),
+	ATCPath NVARCHAR(1023)
 );
+
+-- Drugs tables created before ATCPath need the column:
+-- ALTER TABLE Drugs ADD ATCPath NVARCHAR(1023);
+
+-- Required by --upsert
+CREATE UNIQUE INDEX UX_Drugs_Link ON Drugs (Link);
@@ -0,0 +1,1549 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/antchfx/htmlquery"
+	"github.com/integrii/flaggy"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	pqreader "github.com/xitongsys/parquet-go/reader"
+	"golang.org/x/net/html"
+	"golang.org/x/time/rate"
+)
+
+func TestMain(m *testing.M) {
+	initLogger("ERROR", nil, false)
+	os.Exit(m.Run())
+}
+
+// roundTripFunc serves the requests of the tests without network
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func htmlResponse(req *http.Request, body string) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req}
+}
+
+// fixtureFetcher serves the pages from the HTML files in testdata by URL,
+// a URL without a file fails like a request to the site
+type fixtureFetcher map[string]string
+
+func (f fixtureFetcher) Fetch(ctx context.Context, cnf Config, url string) (*html.Node, string, int, time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", 0, 0, err
+	}
+	name, ok := f[url]
+	if !ok {
+		return nil, "", 0, 0, fmt.Errorf("no fixture for %s", url)
+	}
+	doc, err := htmlquery.LoadDoc(filepath.Join("testdata", name))
+	if err != nil {
+		return nil, "", 0, 0, err
+	}
+	return doc, url, http.StatusOK, 0, nil
+}
+
+// fixtureConfig is the default config fetching from the fixtures
+func fixtureConfig(pages fixtureFetcher) Config {
+	cnf := getConfig()
+	cnf.Fetcher = pages
+	return cnf
+}
+
+func TestFetchDrug(t *testing.T) {
+	const link = "https://tabletki.ua/Aspirin/1002/"
+	cnf := fixtureConfig(fixtureFetcher{link: "drug.html"})
+	cnf.WithOffers = true
+
+	drug, err := fetchDrug(context.Background(), cnf, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Drug{
+		Name:         "Аспирин 500 мг",
+		Link:         link,
+		Dosage:       "500 мг",
+		Manufacture:  "Bayer",
+		INN:          "Ацетилсалициловая кислота",
+		PharmGroup:   "Анальгетики",
+		Registration: "UA/0001/01/01",
+		Form:         "Таблетки",
+		Package:      "10 таблеток",
+		Storage:      "При температуре не выше 25 °C",
+		ATCCode: []ATCEntry{
+			{Code: "N02BA01", Name: "Ацетилсалициловая кислота"},
+			{Code: "B01AC06", Name: "Ацетилсалициловая кислота"}},
+		Price:     "95.50",
+		Available: true,
+		Offers: []Offer{
+			{Pharmacy: "Аптека 1", Price: "95.50", Address: "Киев, ул. Крещатик, 1"}}}
+	instruction := drug.Instruction
+	drug.Instruction = ""
+	if !reflect.DeepEqual(drug, want) {
+		t.Errorf("got\n%+v\nwant\n%+v", drug, want)
+	}
+	for _, text := range []string{"Показания: боль и лихорадка.", "Способ применения: внутрь после еды."} {
+		if !strings.Contains(instruction, text) {
+			t.Errorf("instruction %q has no %q", instruction, text)
+		}
+	}
+	if strings.Contains(instruction, "Перевести") {
+		t.Errorf("instruction %q keeps the translate prompt", instruction)
+	}
+}
+
+func TestFetchDrugLinks(t *testing.T) {
+	const link = "https://tabletki.ua/Aspirin/"
+	cnf := fixtureConfig(fixtureFetcher{link: "drug_links.html"})
+
+	links, err := fetchDrugLinks(context.Background(), cnf, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"https://tabletki.ua/Aspirin/1001/", "https://tabletki.ua/Aspirin/1002/"}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("got %v, want %v without the all dosages link", links, want)
+	}
+}
+
+func TestFetchDrugBaseLinksPages(t *testing.T) {
+	const link = "https://tabletki.ua/atc/A01/"
+	cnf := fixtureConfig(fixtureFetcher{
+		link:             "goods_page1.html",
+		link + "?page=2": "goods_page2.html"})
+
+	links, err := fetchDrugBaseLinks(context.Background(), cnf, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"https://tabletki.ua/Aspirin/", "https://tabletki.ua/Citramon/", "https://tabletki.ua/Analgin/"}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("got %v, want the links of both pages %v", links, want)
+	}
+}
+
+func TestFetchDrugBaseLinksPageLoop(t *testing.T) {
+	const link = "https://tabletki.ua/atc/A01/"
+	// The second page links to itself as the next one
+	cnf := fixtureConfig(fixtureFetcher{
+		link:             "goods_page1.html",
+		link + "?page=2": "goods_page1.html"})
+
+	done := make(chan []string)
+	go func() {
+		links, err := fetchDrugBaseLinks(context.Background(), cnf, link)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- links
+	}()
+	select {
+	case links := <-done:
+		if len(links) != 4 {
+			t.Errorf("got %d links %v, want 4 from the two pages before the loop", len(links), links)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pagination loop is followed forever")
+	}
+}
+
+func TestFetchATCTree(t *testing.T) {
+	cnf := fixtureConfig(fixtureFetcher{
+		tabletkiATCURL:                 "atc_root.html",
+		"https://tabletki.ua/atc/A/":   "atc_a.html",
+		"https://tabletki.ua/atc/A01/": "atc_leaf.html",
+		"https://tabletki.ua/atc/B/":   "atc_leaf.html"})
+
+	tree := &ATCTree{Name: cnf.RootName, Link: tabletkiATCURL}
+	if err := fetchATCTree(context.Background(), cnf, tree, nil, &atcPaths{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.Children) != 2 {
+		t.Fatalf("root has %d children, want 2", len(tree.Children))
+	}
+	groupA, groupB := tree.Children[0], tree.Children[1]
+	if groupA.Name != "A Пищеварительный тракт и обмен веществ" || groupA.Link != "https://tabletki.ua/atc/A/" {
+		t.Errorf("got group %q %s", groupA.Name, groupA.Link)
+	}
+	if len(groupA.Children) != 1 || groupA.Children[0].Name != "A01 Стоматологические препараты" {
+		t.Errorf("got group A children %+v, want A01", groupA.Children)
+	} else if leaf := groupA.Children[0]; leaf.Children == nil || len(leaf.Children) != 0 {
+		t.Errorf("got A01 children %+v, want the empty list", leaf.Children)
+	}
+	if groupB.Children == nil || len(groupB.Children) != 0 {
+		t.Errorf("got group B children %+v, want the empty list", groupB.Children)
+	}
+}
+
+func TestRateLimitSharedByWorkers(t *testing.T) {
+	const rps, workers, perWorker = 20, 4, 5
+	interval := time.Second / rps
+
+	var mu sync.Mutex
+	var times []time.Time
+	cnf := getConfig()
+	cnf.Retries = 0
+	cnf.Limiter = newLimiter(rps)
+	cnf.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+		return htmlResponse(req, "<html><body>ok</body></html>"), nil
+	})}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			cnf := workerConfig(cnf)
+			for i := 0; i < perWorker; i++ {
+				if _, err := loadURL(context.Background(), cnf, fmt.Sprintf("https://tabletki.ua/%d/%d/", w, i)); err != nil {
+					t.Error(err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if len(times) != workers*perWorker {
+		t.Fatalf("got %d requests, want %d", len(times), workers*perWorker)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	// The bucket holds one token, so the requests of all workers together
+	// come one per interval. Half of it is left for the scheduler jitter.
+	for i := 1; i < len(times); i++ {
+		if gap := times[i].Sub(times[i-1]); gap < interval/2 {
+			t.Errorf("request %d came %s after the previous one, want about %s", i, gap, interval)
+		}
+	}
+	if total, want := times[len(times)-1].Sub(times[0]), time.Duration(len(times)-1)*interval*9/10; total < want {
+		t.Errorf("%d requests took %s, want at least %s", len(times), total, want)
+	}
+}
+
+func TestClientPerWorkerKeepsSharedLimiter(t *testing.T) {
+	cnf := getConfig()
+	cnf.ClientPerWorker = true
+	cnf.HTTPClient = newHTTPClient(cnf)
+	cnf.Limiter = newLimiter(cnf.RPS)
+
+	worker := workerConfig(cnf)
+	if worker.HTTPClient == cnf.HTTPClient {
+		t.Error("worker shares the HTTP client with --client-per-worker")
+	}
+	if worker.Limiter != cnf.Limiter {
+		t.Error("worker got its own rate limiter, want the shared one")
+	}
+}
+
+func TestMSSQLConnURLEnvWins(t *testing.T) {
+	const envURL = "sqlserver://env:envpass@db:1433?database=drugs"
+	const flagURL = "sqlserver://flag:flagpass@db:1433?database=drugs"
+
+	t.Setenv("MSSQL_CONN_URL", envURL)
+	cnf := getConfig()
+	cnf.MSSQLConnURL = "sqlserver://file:filepass@db:1433?database=drugs"
+	applyMSSQLConnURL(&cnf, flagURL)
+	if cnf.MSSQLConnURL != envURL {
+		t.Errorf("got %s, want MSSQL_CONN_URL %s", cnf.MSSQLConnURL, envURL)
+	}
+
+	t.Setenv("MSSQL_CONN_URL", "")
+	cnf = getConfig()
+	applyMSSQLConnURL(&cnf, flagURL)
+	if cnf.MSSQLConnURL != flagURL {
+		t.Errorf("got %s, want --mssqlurl %s without MSSQL_CONN_URL", cnf.MSSQLConnURL, flagURL)
+	}
+}
+
+func TestMSSQLLogsRedactPassword(t *testing.T) {
+	const password = "s3cr3t-Pa55"
+	var logs bytes.Buffer
+	initLogger("DEBUG", &logs, false)
+	defer initLogger("ERROR", nil, false)
+
+	for _, connURL := range []string{
+		"sqlserver://user:" + password + "@127.0.0.1:1?database=drugs&dial+timeout=1",
+		"server=127.0.0.1;port=1;user id=user;password=" + password + ";database=drugs;dial timeout=1",
+	} {
+		cnf := getConfig()
+		cnf.MSSQLConnURL = connURL
+		// Nothing listens on the port, the error is logged by main
+		if db, err := openMSSQL(cnf); err != nil {
+			log.Critical(err)
+		} else {
+			db.Close()
+		}
+		if strings.Contains(redactConnURL(connURL), password) {
+			t.Errorf("redactConnURL(%q) keeps the password", connURL)
+		}
+	}
+	if logs.Len() == 0 {
+		t.Fatal("nothing is logged")
+	}
+	if strings.Contains(logs.String(), password) {
+		t.Errorf("logs contain the raw password:\n%s", logs.String())
+	}
+}
+
+func TestFetchEncodedPage(t *testing.T) {
+	const page = `<html><body><div class="header-panel"><h1>Аспирин</h1></div></body></html>`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := r.URL.Query().Get("encoding")
+		var body bytes.Buffer
+		var enc io.WriteCloser
+		switch encoding {
+		case "gzip", "x-gzip":
+			enc = gzip.NewWriter(&body)
+		case "deflate":
+			enc = zlib.NewWriter(&body)
+		case "raw-deflate":
+			enc, _ = flate.NewWriter(&body, flate.DefaultCompression)
+			encoding = "deflate"
+		}
+		if enc != nil {
+			io.WriteString(enc, page)
+			enc.Close()
+		} else {
+			body.WriteString(page)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Encoding", encoding)
+		w.Write(body.Bytes())
+	}))
+	defer server.Close()
+
+	// gzip is decoded by the transport which asked for it, x-gzip and
+	// deflate are left to decodeBody
+	cnf := getConfig()
+	cnf.Retries = 0
+	cnf.HTTPClient = newHTTPClient(cnf)
+	for _, encoding := range []string{"gzip", "x-gzip", "deflate", "raw-deflate", "identity"} {
+		doc, err := loadURL(context.Background(), cnf, server.URL+"/?encoding="+encoding)
+		if err != nil {
+			t.Errorf("%s: %s", encoding, err)
+			continue
+		}
+		if name := htmlText(doc, cnf.Selectors.DrugName); name != "Аспирин" {
+			t.Errorf("%s: got drug name %q, want Аспирин", encoding, name)
+		}
+	}
+}
+
+func TestFetchUnsupportedEncoding(t *testing.T) {
+	cnf := getConfig()
+	cnf.Retries = 0
+	cnf.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp := htmlResponse(req, "not really brotli")
+		resp.Header.Set("Content-Encoding", "br")
+		return resp, nil
+	})}
+	if _, err := loadURL(context.Background(), cnf, "https://tabletki.ua/atc/"); err == nil || !strings.Contains(err.Error(), `"br"`) {
+		t.Errorf("got error %v, want unsupported content encoding br", err)
+	}
+}
+
+// testDrugs makes the drugs with distinct links
+func testDrugs(num int) []Drug {
+	drugs := make([]Drug, num)
+	for i := range drugs {
+		drugs[i] = Drug{Name: fmt.Sprintf("Drug %d", i), Link: fmt.Sprintf("https://tabletki.ua/drug/%d/", i)}
+	}
+	return drugs
+}
+
+func drugsChan(drugs []Drug) <-chan Drug {
+	ch := make(chan Drug, len(drugs))
+	for _, drug := range drugs {
+		ch <- drug
+	}
+	close(ch)
+	return ch
+}
+
+// newMockMSSQLStore is the MSSQL store over sqlmock, the insert query
+// is matched literally
+func newMockMSSQLStore(t *testing.T, cnf Config) (*mssqlDrugStore, sqlmock.Sqlmock, string) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	query, err := mssqlInsertDrugQuery(cnf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &mssqlDrugStore{cnf: cnf, db: db, batcher: newMSSQLBatcher(db, query, cnf.BatchSize, 0)}
+	return store, mock, query
+}
+
+func TestMSSQLBatchCommits(t *testing.T) {
+	const drugsNum, batch = 7, 3
+	cnf := getConfig()
+	cnf.BatchSize = batch
+	store, mock, query := newMockMSSQLStore(t, cnf)
+
+	// 3 + 3 + 1 rows, the last transaction commits the rest
+	for left := drugsNum; left > 0; left -= batch {
+		mock.ExpectBegin()
+		for i := 0; i < batch && i < left; i++ {
+			mock.ExpectExec(query).WillReturnResult(sqlmock.NewResult(0, 1))
+		}
+		mock.ExpectCommit()
+	}
+
+	num, err := store.Save(drugsChan(testDrugs(drugsNum)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != drugsNum {
+		t.Errorf("saved %d drugs, want %d", num, drugsNum)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDrugSQLATCPath(t *testing.T) {
+	cnf := getConfig()
+	cnf.Tags = []Tag{{Key: "source", Value: "tabletki"}}
+	drug := Drug{Name: "Аспирин", Link: "https://tabletki.ua/Aspirin/1001/",
+		ATCPath: []string{"N Нервная система", "N02 Анальгетики"}}
+
+	columns, err := drugSQLColumns(cnf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := drugSQLArgs(cnf, drug)
+	if len(args) != len(columns) {
+		t.Fatalf("got %d args for %d columns", len(args), len(columns))
+	}
+	i := indexOf(columns, "ATCPath")
+	if i < 0 || columns[len(columns)-1] != "source" {
+		t.Fatalf("got columns %q, want ATCPath followed by the tags", columns)
+	}
+	if args[i] != "N Нервная система > N02 Анальгетики" {
+		t.Errorf("got ATCPath %q", args[i])
+	}
+
+	merge, err := mssqlMergeDrugQuery(cnf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(merge, "t.ATCPath = s.ATCPath") {
+		t.Errorf("MERGE does not update ATCPath: %s", merge)
+	}
+}
+
+func TestATCNodesSave(t *testing.T) {
+	tree := &ATCTree{Name: "ATC", Children: []*ATCTree{
+		{Name: "A Пищеварительный тракт", Children: []*ATCTree{}},
+		{Name: "B Кровь", Children: []*ATCTree{}}}}
+	const insertQuery = "INSERT INTO ATCNodes VALUES (@p1, @p2, @p3, @p4, @p5, @p6)"
+
+	for _, upsert := range []bool{false, true} {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cnf := getConfig()
+		cnf.BatchSize = 2
+		cnf.Upsert = upsert
+
+		// 2 + 1 nodes, the table is emptied in the first transaction only
+		query := insertQuery
+		if upsert {
+			query = mssqlMergeATCNodeQuery
+		}
+		mock.ExpectExec(mssqlCreateATCNodesQuery).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectBegin()
+		if !upsert {
+			mock.ExpectExec("TRUNCATE TABLE ATCNodes").WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+		mock.ExpectExec(query).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(query).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		mock.ExpectBegin()
+		mock.ExpectExec(query).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		num, err := saveATCNodes(db, tree, cnf)
+		if err != nil {
+			t.Fatalf("upsert %t: %s", upsert, err)
+		}
+		if num != 3 {
+			t.Errorf("upsert %t: saved %d nodes, want 3", upsert, num)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("upsert %t: %s", upsert, err)
+		}
+		db.Close()
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	var logs bytes.Buffer
+	initLogger("WARNING", &logs, false)
+	defer initLogger("ERROR", nil, false)
+
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"config.yaml": "workers: 5\ncsvfile: file.csv\nbatch: 50\nwrokers: 3\n",
+		"config.json": `{"workers": 5, "csvfile": "file.csv", "batch": 50, "wrokers": 3}`,
+	} {
+		logs.Reset()
+		configFile := filepath.Join(dir, name)
+		if err := os.WriteFile(configFile, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		args := []string{"--config", configFile, "--workers", "7"}
+		if got := configFileArg(args); got != configFile {
+			t.Fatalf("configFileArg got %q, want %q", got, configFile)
+		}
+
+		// The same layers as in main: defaults < config file < flags
+		cnf := getConfig()
+		if err := loadConfigFile(configFile, &cnf); err != nil {
+			t.Fatal(err)
+		}
+		parser := flaggy.NewParser("tabletki")
+		parser.String(&configFile, "", "config", "")
+		parser.Int(&cnf.WorkersNum, "", "workers", "")
+		parser.String(&cnf.CSVFileName, "", "csvfile", "")
+		parser.Int(&cnf.BatchSize, "", "batch", "")
+		parser.Int(&cnf.LogEvery, "", "log-every", "")
+		if err := parser.ParseArgs(args); err != nil {
+			t.Fatal(err)
+		}
+
+		if cnf.WorkersNum != 7 {
+			t.Errorf("%s: workers %d, want 7 from the flag over the file", name, cnf.WorkersNum)
+		}
+		if cnf.CSVFileName != "file.csv" || cnf.BatchSize != 50 {
+			t.Errorf("%s: csvfile %q and batch %d, want file.csv and 50 from the file", name, cnf.CSVFileName, cnf.BatchSize)
+		}
+		if want := getConfig().LogEvery; cnf.LogEvery != want {
+			t.Errorf("%s: log-every %d, want the default %d", name, cnf.LogEvery, want)
+		}
+		if !strings.Contains(logs.String(), `Unknown key "wrokers"`) {
+			t.Errorf("%s: no warning about the unknown key in the logs:\n%s", name, logs.String())
+		}
+	}
+}
+
+func TestConfigFileArg(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"drugs", "--config", "a.yaml"}, "a.yaml"},
+		{[]string{"drugs", "--config=a.yaml"}, "a.yaml"},
+		{[]string{"-config", "a.yaml", "drugs"}, "a.yaml"},
+		{[]string{"drugs", "--config"}, ""},
+		{[]string{"drugs", "--workers", "5"}, ""},
+	} {
+		if got := configFileArg(tc.args); got != tc.want {
+			t.Errorf("configFileArg(%q) = %q, want %q", tc.args, got, tc.want)
+		}
+	}
+}
+
+// wideATCFetcher serves an ATC tree of width groups with width subgroups
+// each and records the most pages fetched at once
+type wideATCFetcher struct {
+	width int
+
+	mu      sync.Mutex
+	current int
+	max     int
+}
+
+func (f *wideATCFetcher) Fetch(ctx context.Context, cnf Config, url string) (*html.Node, string, int, time.Duration, error) {
+	f.mu.Lock()
+	f.current++
+	if f.current > f.max {
+		f.max = f.current
+	}
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.current--
+		f.mu.Unlock()
+	}()
+	time.Sleep(2 * time.Millisecond)
+
+	code := strings.Trim(strings.TrimPrefix(url, tabletkiATCURL), "/")
+	var page strings.Builder
+	page.WriteString(`<html><body><h1>` + code + `</h1><div id="ATCPanel"><ul>`)
+	if len(code) < 2 {
+		for i := 0; i < f.width; i++ {
+			child := fmt.Sprintf("%s%c", code, 'A'+i)
+			fmt.Fprintf(&page, `<li><a href="//tabletki.ua/atc/%s/" title="%s Group">%s</a></li>`, child, child, child)
+		}
+	}
+	page.WriteString(`</ul></div></body></html>`)
+	doc, err := html.Parse(strings.NewReader(page.String()))
+	return doc, url, http.StatusOK, 0, err
+}
+
+func TestATCCrawlBoundedByWorkers(t *testing.T) {
+	const width, workers = 8, 3
+	fetcher := &wideATCFetcher{width: width}
+	cnf := getConfig()
+	cnf.WorkersNum = workers
+	cnf.Fetcher = fetcher
+
+	tree := &ATCTree{Name: cnf.RootName, Link: tabletkiATCURL}
+	if err := fetchATCTree(context.Background(), cnf, tree, nil, &atcPaths{}); err != nil {
+		t.Fatal(err)
+	}
+	if fetcher.max > workers {
+		t.Errorf("%d pages fetched at once, want at most --workers %d", fetcher.max, workers)
+	}
+	if fetcher.max < 2 {
+		t.Errorf("%d pages fetched at once, the crawl is not parallel", fetcher.max)
+	}
+
+	// The whole tree is loaded in the page order
+	if len(tree.Children) != width {
+		t.Fatalf("root has %d children, want %d", len(tree.Children), width)
+	}
+	for i, group := range tree.Children {
+		if want := fmt.Sprintf("%c Group", 'A'+i); group.Name != want {
+			t.Errorf("group %d is %q, want %q", i, group.Name, want)
+		}
+		if len(group.Children) != width {
+			t.Errorf("group %s has %d children, want %d", group.Name, len(group.Children), width)
+			continue
+		}
+		for j, sub := range group.Children {
+			if want := fmt.Sprintf("%c%c Group", 'A'+i, 'A'+j); sub.Name != want || sub.Children == nil || len(sub.Children) != 0 {
+				t.Errorf("subgroup %d/%d is %q with children %v, want %q without children", i, j, sub.Name, sub.Children, want)
+			}
+		}
+	}
+}
+
+// memDrugStore keeps the saved drugs in memory
+type memDrugStore struct {
+	drugs []Drug
+}
+
+func (s *memDrugStore) Save(drugsChan <-chan Drug) (int, error) {
+	for drug := range drugsChan {
+		s.drugs = append(s.drugs, drug)
+	}
+	return len(s.drugs), nil
+}
+
+func (s *memDrugStore) Close() {}
+
+func TestScanDrugsToStore(t *testing.T) {
+	cnf := fixtureConfig(fixtureFetcher{
+		tabletkiATCURL:                      "atc_root.html",
+		"https://tabletki.ua/atc/A/":        "goods_page1.html",
+		"https://tabletki.ua/atc/A/?page=2": "goods_page2.html",
+		"https://tabletki.ua/atc/B/":        "goods_page2.html",
+		"https://tabletki.ua/Aspirin/":      "drug_links.html",
+		"https://tabletki.ua/Citramon/":     "drug_links.html",
+		"https://tabletki.ua/Analgin/":      "drug_links.html",
+		"https://tabletki.ua/Aspirin/1001/": "drug.html",
+		"https://tabletki.ua/Aspirin/1002/": "drug.html"})
+	cnf.WorkersNum = 2
+	cnf.DiscoveryNum = 2
+
+	store := &memDrugStore{}
+	if err := scanDrugs(context.Background(), cnf, store); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every goods list links the same two dosages, they are saved once
+	links := make([]string, len(store.drugs))
+	for i, drug := range store.drugs {
+		links[i] = drug.Link
+		if drug.Name != "Аспирин 500 мг" || drug.Manufacture != "Bayer" {
+			t.Errorf("drug %s is parsed as %q by %q", drug.Link, drug.Name, drug.Manufacture)
+		}
+		if len(drug.ATCPath) != 1 {
+			t.Errorf("drug %s has ATC path %q, want the ATC group", drug.Link, drug.ATCPath)
+		}
+	}
+	sort.Strings(links)
+	if want := []string{"https://tabletki.ua/Aspirin/1001/", "https://tabletki.ua/Aspirin/1002/"}; !reflect.DeepEqual(links, want) {
+		t.Errorf("saved %v, want %v", links, want)
+	}
+}
+
+func TestScanAllDeadline(t *testing.T) {
+	cnf := fixtureConfig(fixtureFetcher{
+		tabletkiATCURL:               "atc_root.html",
+		"https://tabletki.ua/atc/A/": "atc_a.html"})
+	cnf.TreeOut = filepath.Join(t.TempDir(), "atc.json")
+
+	// The deadline is reached before the first page
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if err := scanAll(ctx, cnf, &memDrugStore{}); err != nil {
+		t.Fatalf("interrupted scan failed with %v, want the partial results saved", err)
+	}
+	var tree ATCTree
+	data, err := os.ReadFile(cnf.TreeOut)
+	if err != nil {
+		t.Fatalf("partial ATC tree is not saved: %s", err)
+	}
+	if err := json.Unmarshal(data, &tree); err != nil {
+		t.Fatal(err)
+	}
+	if tree.Name != cnf.RootName {
+		t.Errorf("got ATC tree root %q, want %q", tree.Name, cnf.RootName)
+	}
+
+	// Expired deadline is a net.Error as well
+	if code := exitCode(fmt.Errorf("HTTP request error: %w", context.DeadlineExceeded)); code != exitDeadline {
+		t.Errorf("got exit code %d for the deadline, want %d", code, exitDeadline)
+	}
+}
+
+// failingDrugStore takes the first drug and fails like a lost database
+type failingDrugStore struct{}
+
+func (failingDrugStore) Save(drugsChan <-chan Drug) (int, error) {
+	<-drugsChan
+	return 0, errors.New("database is gone")
+}
+
+func (failingDrugStore) Close() {}
+
+// countingFetcher counts the fetches and makes every one take a moment
+type countingFetcher struct {
+	Fetcher
+	fetched int64
+}
+
+func (f *countingFetcher) Fetch(ctx context.Context, cnf Config, url string) (*html.Node, string, int, time.Duration, error) {
+	atomic.AddInt64(&f.fetched, 1)
+	time.Sleep(time.Millisecond)
+	return f.Fetcher.Fetch(ctx, cnf, url)
+}
+
+func TestScrapeDrugsStoreFailure(t *testing.T) {
+	// Every other drug page fails, so the workers write the errors
+	// file while the store fails
+	pages := fixtureFetcher{}
+	links := make(chan string, 200)
+	for i := 0; i < cap(links); i++ {
+		link := fmt.Sprintf("https://tabletki.ua/Aspirin/%d/", i)
+		if i%2 == 0 {
+			pages[link] = "drug.html"
+		}
+		links <- link
+	}
+	close(links)
+	fetcher := &countingFetcher{Fetcher: pages}
+	cnf := getConfig()
+	cnf.Fetcher = fetcher
+	cnf.WorkersNum = 4
+	cnf.Buffer = cap(links)
+	cnf.ErrorsFile = filepath.Join(t.TempDir(), "errors.jsonl")
+
+	ctx := context.Background()
+	scanCtx, cancelScan := context.WithCancel(ctx)
+	defer cancelScan()
+	_, err := scrapeDrugs(ctx, scanCtx, cancelScan, cnf, failingDrugStore{}, links, nil)
+	if err == nil || err.Error() != "database is gone" {
+		t.Fatalf("got error %v, want the store error", err)
+	}
+
+	// The errors file is closed, nothing may be fetched and added to it
+	fetched := atomic.LoadInt64(&fetcher.fetched)
+	time.Sleep(20 * time.Millisecond)
+	if now := atomic.LoadInt64(&fetcher.fetched); now != fetched {
+		t.Errorf("workers fetched %d pages after the store failed", now-fetched)
+	}
+	if _, err := readErrorsFile(cnf.ErrorsFile); err != nil {
+		t.Errorf("errors file is not readable: %s", err)
+	}
+}
+
+// batchDrugStore reports every two drugs as saved and fails on the fifth,
+// like a database lost in the middle of the scan
+type batchDrugStore struct {
+	savedHook
+	reported []string
+}
+
+func (s *batchDrugStore) Save(drugsChan <-chan Drug) (int, error) {
+	batch := make([]Drug, 0, 2)
+	num := 0
+	for drug := range drugsChan {
+		if num++; num == 5 {
+			return 4, errors.New("database is gone")
+		}
+		if batch = append(batch, drug); len(batch) == 2 {
+			for _, drug := range batch {
+				s.reported = append(s.reported, drug.Link)
+			}
+			s.saved(batch)
+			batch = batch[:0]
+		}
+	}
+	return num, nil
+}
+
+func (s *batchDrugStore) Close() {}
+
+// drugLinksChan returns the closed channel of num drug links, all served
+// by the drug fixture
+func drugLinksChan(num int) (fixtureFetcher, <-chan string) {
+	pages := fixtureFetcher{}
+	links := make(chan string, num)
+	for i := 0; i < num; i++ {
+		link := fmt.Sprintf("https://tabletki.ua/Aspirin/%d/", i)
+		pages[link] = "drug.html"
+		links <- link
+	}
+	close(links)
+	return pages, links
+}
+
+func TestCheckpointMarksSavedDrugs(t *testing.T) {
+	pages, links := drugLinksChan(10)
+	cnf := fixtureConfig(pages)
+	cnf.Buffer = 10
+	cnf.CheckpointFile = filepath.Join(t.TempDir(), "drugs.checkpoint")
+
+	ctx := context.Background()
+	scanCtx, cancelScan := context.WithCancel(ctx)
+	defer cancelScan()
+	store := &batchDrugStore{}
+	if _, err := scrapeDrugs(ctx, scanCtx, cancelScan, cnf, store, links, nil); err == nil {
+		t.Fatal("store error is not returned")
+	}
+
+	// Only the reported drugs are processed, the fifth one is lost
+	cp, err := loadCheckpoint(cnf.CheckpointFile, cnf.CheckpointEvery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.Len() != len(store.reported) || len(store.reported) != 4 {
+		t.Fatalf("checkpoint has %d links, want the %d reported ones", cp.Len(), len(store.reported))
+	}
+	for _, link := range store.reported {
+		if !cp.Has(link) {
+			t.Errorf("checkpoint misses the saved drug %s", link)
+		}
+	}
+}
+
+func TestCheckpointRemovedWhenComplete(t *testing.T) {
+	for _, limit := range []int{0, 3} {
+		pages, links := drugLinksChan(5)
+		cnf := fixtureConfig(pages)
+		cnf.Limit = limit
+		cnf.CheckpointFile = filepath.Join(t.TempDir(), "drugs.checkpoint")
+
+		ctx := context.Background()
+		scanCtx, cancelScan := context.WithCancel(ctx)
+		if _, err := scrapeDrugs(ctx, scanCtx, cancelScan, cnf, &memDrugStore{}, links, nil); err != nil {
+			t.Fatal(err)
+		}
+		cancelScan()
+
+		_, err := os.Stat(cnf.CheckpointFile)
+		if limit == 0 && !os.IsNotExist(err) {
+			t.Errorf("checkpoint of the complete scan is not removed: %v", err)
+		}
+		if limit > 0 {
+			// The scan stopped by --limit resumes with the rest of the drugs
+			cp, err := loadCheckpoint(cnf.CheckpointFile, cnf.CheckpointEvery)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cp.Len() != limit {
+				t.Errorf("checkpoint of the --limit %d scan has %d links", limit, cp.Len())
+			}
+		}
+	}
+}
+
+func TestResumeAppends(t *testing.T) {
+	dir := t.TempDir()
+	cnf := getConfig()
+	cnf.CheckpointFile = filepath.Join(dir, "drugs.checkpoint")
+	if err := resumeAppend(&cnf); err != nil || cnf.Append {
+		t.Fatalf("scan without checkpoint appends: %t, %v", cnf.Append, err)
+	}
+
+	if err := os.WriteFile(cnf.CheckpointFile, []byte(`["https://tabletki.ua/Aspirin/1001/"]`), 0664); err != nil {
+		t.Fatal(err)
+	}
+	if err := resumeAppend(&cnf); err != nil || !cnf.Append {
+		t.Fatalf("resumed scan appends: %t, %v", cnf.Append, err)
+	}
+	cnf.DrugsJSONFile = filepath.Join(dir, "drugs.json")
+	if _, err := newDrugStore(cnf); exitCode(err) != exitConfig {
+		t.Errorf("resuming into JSON got %v, want the config error", err)
+	}
+}
+
+// readGzipFile returns the decompressed content of the file
+func readGzipFile(t *testing.T, fileName string) []byte {
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestGzipOutputRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	cnf := getConfig()
+	cnf.Gzip = true
+	cnf.CSVFileName = filepath.Join(dir, "drugs.csv")
+	cnf.DrugsJSONFile = filepath.Join(dir, "drugs.json")
+	cnf.JSONFileName = filepath.Join(dir, "tree.json")
+	drugs := testDrugs(3)
+
+	// CSV, the appended run adds a gzip member without another header
+	for _, appendRun := range []bool{false, true} {
+		cnf.Append = appendRun
+		store, err := newCSVDrugStore(cnf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Save(drugsChan(drugs)); err != nil {
+			t.Fatal(err)
+		}
+		store.Close()
+	}
+	rows, err := csv.NewReader(bytes.NewReader(readGzipFile(t, cnf.CSVFileName+".gz"))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1+2*len(drugs) || !reflect.DeepEqual(rows[0], drugCSVHeaders(cnf)) {
+		t.Fatalf("got CSV rows %q, want the header and the drugs twice", rows)
+	}
+	for i, row := range rows[1:] {
+		if drug := drugs[i%len(drugs)]; row[0] != drug.Name || row[1] != drug.Link {
+			t.Errorf("CSV row %d is %q, want %s %s", i+1, row[:2], drug.Name, drug.Link)
+		}
+	}
+
+	// Drugs JSON
+	jsonStore, err := newJSONDrugStore(cnf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jsonStore.Save(drugsChan(drugs)); err != nil {
+		t.Fatal(err)
+	}
+	jsonStore.Close()
+	var jsonDrugs []Drug
+	if err := json.Unmarshal(readGzipFile(t, cnf.DrugsJSONFile+".gz"), &jsonDrugs); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(jsonDrugs, drugs) {
+		t.Errorf("got JSON drugs %+v, want %+v", jsonDrugs, drugs)
+	}
+
+	// ATC tree
+	tree := &ATCTree{Name: cnf.RootName, Children: []*ATCTree{
+		{Name: "A Пищеварительный тракт и обмен веществ", Children: []*ATCTree{}}}}
+	if err := saveATCTree(cnf, tree); err != nil {
+		t.Fatal(err)
+	}
+	var savedTree ATCTree
+	if err := json.Unmarshal(readGzipFile(t, cnf.JSONFileName+".gz"), &savedTree); err != nil {
+		t.Fatal(err)
+	}
+	if savedTree.Name != tree.Name || len(savedTree.Children) != 1 || savedTree.Children[0].Name != tree.Children[0].Name {
+		t.Errorf("got ATC tree %+v, want %+v", savedTree, tree)
+	}
+}
+
+func TestLinksMultiFetcherCancel(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	cnf := getConfig()
+	cnf.Buffer = 1
+
+	// The input never ends and nobody reads the most of the output,
+	// so the workers are stuck on both channels when the scan is cancelled
+	inChan := make(chan string)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case inChan <- fmt.Sprintf("https://tabletki.ua/atc/%d/", i):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	outChan := linksMultiFetcher(ctx, cnf, inChan, 4, func(ctx context.Context, cnf Config, url string) ([]string, error) {
+		return []string{url + "1/", url + "2/", url + "3/"}, nil
+	})
+	<-outChan
+	cancel()
+
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case _, ok := <-outChan:
+			done = !ok
+		case <-timeout:
+			t.Fatal("output channel is not closed after cancellation")
+		}
+	}
+
+	// The workers and the goroutine closing the output are gone
+	for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > goroutines; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left, %d before the fetcher", runtime.NumGoroutine(), goroutines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestATCTreeXMLRoundTrip(t *testing.T) {
+	tree := &ATCTree{Name: "АТХ (ATC) классификация", Children: []*ATCTree{
+		{Name: "A Пищеварительный тракт и обмен веществ", Children: []*ATCTree{
+			{Name: "A01 Стоматологические препараты", Children: []*ATCTree{}},
+			{Name: "A02 Препараты для лечения заболеваний, связанных с нарушением кислотности & <язва>", Children: []*ATCTree{}}}},
+		{Name: "B Кровь и органы кроветворения", Children: []*ATCTree{}}}}
+
+	var data bytes.Buffer
+	if err := writeTreeXML(&data, tree, getConfig()); err != nil {
+		t.Fatal(err)
+	}
+	var decoded ATCTree
+	if err := xml.Unmarshal(data.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded.Children) != 2 || len(decoded.Children[0].Children) != 2 {
+		t.Fatalf("decoded tree %+v does not nest as %+v", decoded, tree)
+	}
+	if got, want := decoded.Children[0].Children[1].Name, tree.Children[0].Children[1].Name; got != want {
+		t.Errorf("decoded name %q, want %q", got, want)
+	}
+	var again bytes.Buffer
+	if err := writeTreeXML(&again, &decoded, getConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if again.String() != data.String() {
+		t.Errorf("decoded tree is written as\n%s\nwant\n%s", again.String(), data.String())
+	}
+}
+
+func TestParquetReadBack(t *testing.T) {
+	cnf := getConfig()
+	cnf.ParquetFile = filepath.Join(t.TempDir(), "drugs.parquet")
+	drugs := testDrugs(3)
+	drugs[0].Instruction = strings.Repeat("Показания: боль и лихорадка.\n", 2000)
+	drugs[0].ATCCode = []ATCEntry{{Code: "N02BA01", Name: "Ацетилсалициловая кислота"}}
+	drugs[1].Available = true
+	drugs[2].FetchMillis = 120
+
+	store, err := newParquetDrugStore(cnf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Save(drugsChan(drugs)); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	file, err := local.NewLocalFileReader(cnf.ParquetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := pqreader.NewParquetReader(file, new(parquetDrug), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.ReadStop()
+
+	// The first schema element is the root, a column per field follows
+	columns := make(map[string]parquet.Type)
+	for _, element := range reader.Footer.Schema[1:] {
+		columns[element.GetName()] = element.GetType()
+	}
+	if num := reflect.TypeOf(parquetDrug{}).NumField(); len(columns) != num {
+		t.Errorf("got %d columns %v, want %d", len(columns), columns, num)
+	}
+	for column, want := range map[string]parquet.Type{
+		"Name":        parquet.Type_BYTE_ARRAY,
+		"Instruction": parquet.Type_BYTE_ARRAY,
+		"Available":   parquet.Type_BOOLEAN,
+		"FetchMillis": parquet.Type_INT64,
+	} {
+		if got, ok := columns[column]; !ok || got != want {
+			t.Errorf("column %s has type %v, want %v", column, got, want)
+		}
+	}
+
+	rows := make([]parquetDrug, reader.GetNumRows())
+	if err := reader.Read(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(drugs) {
+		t.Fatalf("read %d rows, want %d", len(rows), len(drugs))
+	}
+	for i, row := range rows {
+		if want := newParquetDrug(drugs[i]); row != want {
+			t.Errorf("row %d is %+v, want %+v", i, row, want)
+		}
+	}
+}
+
+func TestNormalizeText(t *testing.T) {
+	for _, tc := range []struct {
+		text      string
+		keepLines bool
+		want      string
+	}{
+		{"\n\t\tBayer\u00a0AG,\n\t\tГермания\n", false, "Bayer AG, Германия"},
+		{"500\u00a0мг", false, "500 мг"},
+		{"\u00a0\u00a0Таблетки\u00a0", false, "Таблетки"},
+		{"UA/\u200b0001/01/01\ufeff", false, "UA/0001/01/01"},
+		{"  ", false, ""},
+		{"Показания:\r\n\t боль и\u00a0 лихорадка.\n\n\n  Способ применения:  внутрь.\n", true,
+			"Показания:\nболь и лихорадка.\nСпособ применения: внутрь."},
+		{"\u00a0\n \u200b\n", true, ""},
+	} {
+		if got := normalizeText(tc.text, tc.keepLines); got != tc.want {
+			t.Errorf("normalizeText(%q, %t) = %q, want %q", tc.text, tc.keepLines, got, tc.want)
+		}
+	}
+}
+
+func TestInstructionParagraphs(t *testing.T) {
+	doc, err := html.Parse(strings.NewReader(`<div itemprop="description">
+		<p><b>Состав:</b>&nbsp;действующее
+		вещество: ацетилсалициловая кислота;</p><p>Показания:<br>боль&nbsp;и лихорадка.</p>
+		<script>var x = 1;</script><ul><li>Форма: таблетки</li></ul></div>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Состав: действующее вещество: ацетилсалициловая кислота;\nПоказания:\nболь и лихорадка.\nФорма: таблетки"
+	if got := normalizeText(htmlParagraphs(doc, getConfig().Selectors.Instruction), true); got != want {
+		t.Errorf("got instruction %q, want %q", got, want)
+	}
+}
+
+// newRedirectServer serves the drug page at /new/, /old/ is moved there
+// through /renamed/
+func newRedirectServer(t *testing.T) *httptest.Server {
+	page, err := os.ReadFile(filepath.Join("testdata", "drug.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/old/", http.RedirectHandler("/renamed/", http.StatusMovedPermanently))
+	mux.Handle("/renamed/", http.RedirectHandler("/new/", http.StatusFound))
+	mux.HandleFunc("/new/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFetchDrugRedirected(t *testing.T) {
+	server := newRedirectServer(t)
+	cnf := getConfig()
+	cnf.Retries = 0
+	cnf.DebugFields = true
+	cnf.HTTPClient = newHTTPClient(cnf)
+
+	drug, err := fetchDrug(context.Background(), cnf, server.URL+"/old/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drug.Link != server.URL+"/new/" || drug.RequestedURL != server.URL+"/old/" {
+		t.Errorf("got link %s requested as %s, want the final %s/new/ requested as /old/", drug.Link, drug.RequestedURL, server.URL)
+	}
+	if drug.Name != "Аспирин 500 мг" || drug.HTTPStatus != http.StatusOK {
+		t.Errorf("got drug %q with status %d from the final page", drug.Name, drug.HTTPStatus)
+	}
+
+	// Not redirected page keeps no requested URL
+	drug, err = fetchDrug(context.Background(), cnf, server.URL+"/new/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drug.Link != server.URL+"/new/" || drug.RequestedURL != "" {
+		t.Errorf("got link %s requested as %q, want %s/new/ only", drug.Link, drug.RequestedURL, server.URL)
+	}
+}
+
+func TestFetchDrugTimeWithoutLimiterWait(t *testing.T) {
+	server := newRedirectServer(t)
+	cnf := getConfig()
+	cnf.Retries = 0
+	cnf.RecordTiming = true
+	cnf.HTTPClient = newHTTPClient(cnf)
+	// The second fetch waits for the limiter, the request is as quick
+	cnf.Limiter = rate.NewLimiter(rate.Every(100*time.Millisecond), 1)
+
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		drug, err := fetchDrug(context.Background(), cnf, server.URL+"/new/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if took := time.Since(start); i == 1 && took < 80*time.Millisecond {
+			t.Fatalf("second fetch took %s, the limiter does not wait", took)
+		}
+		if drug.FetchMillis >= 80 {
+			t.Errorf("fetch %d recorded %d ms, the limiter wait is counted", i+1, drug.FetchMillis)
+		}
+	}
+}
+
+func TestFetchDrugNoFollowRedirects(t *testing.T) {
+	server := newRedirectServer(t)
+	cnf := getConfig()
+	cnf.Retries = 0
+	cnf.NoFollowRedirects = true
+	cnf.HTTPClient = newHTTPClient(cnf)
+
+	_, err := fetchDrug(context.Background(), cnf, server.URL+"/old/")
+	var statusErr *httpStatusError
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("got error %v, want the unexpected status", err)
+	}
+	if statusErr.StatusCode != http.StatusMovedPermanently || statusErr.Location != "/renamed/" {
+		t.Errorf("got status %d moved to %q, want 301 moved to /renamed/", statusErr.StatusCode, statusErr.Location)
+	}
+}
+
+func TestTruncateTextRunes(t *testing.T) {
+	for _, tc := range []struct {
+		text   string
+		maxLen int
+		want   string
+	}{
+		{"Показания: боль и лихорадка.", 10, "Показания…"},
+		{"Показания", 9, "Показания"},
+		{"Показания", 100, "Показания"},
+		{"Ґудзик їжачка", 2, "Ґ…"},
+		{"Жар 🌡 и боль", 6, "Жар 🌡…"},
+		{"Жар", 1, "…"},
+	} {
+		got := truncateText(tc.text, tc.maxLen)
+		if got != tc.want {
+			t.Errorf("truncateText(%q, %d) = %q, want %q", tc.text, tc.maxLen, got, tc.want)
+		}
+		if !utf8.ValidString(got) || utf8.RuneCountInString(got) > tc.maxLen {
+			t.Errorf("truncateText(%q, %d) = %q is broken or longer than %d chars", tc.text, tc.maxLen, got, tc.maxLen)
+		}
+	}
+}
+
+func TestFetchDrugMaxInstructionLen(t *testing.T) {
+	const link = "https://tabletki.ua/Aspirin/1002/"
+	cnf := fixtureConfig(fixtureFetcher{link: "drug.html"})
+	cnf.MaxInstrLen = 15
+
+	drug, err := fetchDrug(context.Background(), cnf, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Показания: бол…"; drug.Instruction != want {
+		t.Errorf("got instruction %q, want %q", drug.Instruction, want)
+	}
+}
+
+// drugSQLValues are the insert arguments of the drug as sqlmock expects them
+func drugSQLValues(cnf Config, drug Drug) []driver.Value {
+	args := drugSQLArgs(cnf, drug)
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg
+	}
+	return values
+}
+
+func TestMSSQLSkipFailedRow(t *testing.T) {
+	var logs bytes.Buffer
+	initLogger("ERROR", &logs, false)
+	defer initLogger("ERROR", nil, false)
+
+	cnf := getConfig()
+	store, mock, query := newMockMSSQLStore(t, cnf)
+	drugs := testDrugs(4)
+	failedRows := atomic.LoadInt64(&stats.FailedRows)
+
+	// The second drug is refused, the first one is replayed in a new
+	// transaction and the rest go on in it
+	mock.ExpectBegin()
+	mock.ExpectExec(query).WithArgs(drugSQLValues(cnf, drugs[0])...).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(query).WithArgs(drugSQLValues(cnf, drugs[1])...).
+		WillReturnError(errors.New("String or binary data would be truncated"))
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	for _, drug := range []Drug{drugs[0], drugs[2], drugs[3]} {
+		mock.ExpectExec(query).WithArgs(drugSQLValues(cnf, drug)...).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+
+	num, err := store.Save(drugsChan(drugs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != len(drugs)-1 {
+		t.Errorf("saved %d drugs, want %d without the failed one", num, len(drugs)-1)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	if failed := atomic.LoadInt64(&stats.FailedRows) - failedRows; failed != 1 {
+		t.Errorf("%d failed rows counted, want 1", failed)
+	}
+	if !strings.Contains(logs.String(), drugs[1].Link) {
+		t.Errorf("failed drug %s is not logged:\n%s", drugs[1].Link, logs.String())
+	}
+}
+
+func TestBackoffDelayBounds(t *testing.T) {
+	const base, samples = 100 * time.Millisecond, 1000
+	for n := 0; n <= 10; n++ {
+		ceiling := base << n
+		low, high := ceiling, time.Duration(0)
+		for i := 0; i < samples; i++ {
+			delay := backoffDelay(base, n)
+			if delay < 0 || delay > ceiling {
+				t.Fatalf("backoff %d delay %s is out of [0, %s]", n, delay, ceiling)
+			}
+			if delay < low {
+				low = delay
+			}
+			if delay > high {
+				high = delay
+			}
+		}
+		// Full jitter spreads the delays over the whole range
+		if low > ceiling/4 || high < ceiling*3/4 {
+			t.Errorf("backoff %d delays are in [%s, %s], want spread over [0, %s]", n, low, high, ceiling)
+		}
+	}
+
+	// The ceiling stops doubling before it overflows
+	for _, n := range []int{62, 63, 100} {
+		if delay := backoffDelay(base, n); delay < 0 {
+			t.Errorf("backoff %d delay %s is negative", n, delay)
+		}
+	}
+	if delay := backoffDelay(0, 3); delay != 0 {
+		t.Errorf("got delay %s without the base, want 0", delay)
+	}
+}
+
+// benchmarkWorkersFetch fetches b.N pages from the server by the workers
+// with the client the worker config gets, pausing for --delay between the
+// pages as the scan does
+func benchmarkWorkersFetch(b *testing.B, cnf Config, url string) {
+	var next int64
+	var wg sync.WaitGroup
+	for w := 0; w < cnf.WorkersNum; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cnf := workerConfig(cnf)
+			for atomic.AddInt64(&next, 1) <= int64(b.N) {
+				if _, err := loadURL(context.Background(), cnf, url); err != nil {
+					b.Error(err)
+					return
+				}
+				workerDelay(context.Background(), cnf)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// BenchmarkHTTPClientPool compares the transport defaults, which keep only
+// 2 idle connections per host, with the pool sized by --workers
+func BenchmarkHTTPClientPool(b *testing.B) {
+	var conns int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The site takes a while to answer
+		time.Sleep(time.Millisecond)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, "<html><body><h1>Аспирин</h1></body></html>")
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	// The workers are idle between the pages, so their connections are
+	// idle at the same time too
+	cnf := getConfig()
+	cnf.Retries = 0
+	cnf.Delay = time.Millisecond
+	for _, bc := range []struct {
+		name   string
+		config func(cnf Config) Config
+	}{
+		{"transport-defaults", func(cnf Config) Config {
+			cnf.HTTPClient = &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}
+			return cnf
+		}},
+		{"pool-by-workers", func(cnf Config) Config {
+			cnf.HTTPClient = newHTTPClient(cnf)
+			return cnf
+		}},
+		{"client-per-worker", func(cnf Config) Config {
+			cnf.ClientPerWorker = true
+			cnf.HTTPClient = newHTTPClient(cnf)
+			return cnf
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			cnf := bc.config(cnf)
+			atomic.StoreInt64(&conns, 0)
+			b.ResetTimer()
+			benchmarkWorkersFetch(b, cnf, server.URL+"/")
+			b.StopTimer()
+			b.ReportMetric(float64(atomic.LoadInt64(&conns))/float64(b.N), "conns/op")
+			server.CloseClientConnections()
+		})
+	}
+}
+
+// siteFetcher serves a made-up site of groups ATC groups with goods drugs
+// each, every drug has dosages pages. A page takes up to latency.
+type siteFetcher struct {
+	groups, goods, dosages int
+	latency                time.Duration
+}
+
+func (f siteFetcher) Fetch(ctx context.Context, cnf Config, url string) (*html.Node, string, int, time.Duration, error) {
+	time.Sleep(time.Duration(rand.Int63n(int64(f.latency) + 1)))
+	path := strings.TrimPrefix(url, "https://tabletki.ua/")
+	var page strings.Builder
+	page.WriteString("<html><body>")
+	switch {
+	case path == "atc/":
+		page.WriteString(`<div id="ATCPanel"><ul>`)
+		for i := 0; i < f.groups; i++ {
+			fmt.Fprintf(&page, `<li><a href="//tabletki.ua/group/%d/" title="A%02d Group">A%02d</a></li>`, i, i, i)
+		}
+		page.WriteString(`</ul></div>`)
+	case strings.HasPrefix(path, "group/"):
+		group := strings.Trim(strings.TrimPrefix(path, "group/"), "/")
+		page.WriteString(`<div id="GoodsListPanel">`)
+		for i := 0; i < f.goods; i++ {
+			fmt.Fprintf(&page, `<div><a href="//tabletki.ua/drug/%s-%d/">Drug</a></div>`, group, i)
+		}
+		page.WriteString(`</div>`)
+	case strings.HasPrefix(path, "drug/"):
+		drug := strings.Trim(strings.TrimPrefix(path, "drug/"), "/")
+		page.WriteString(`<div class="search-control-panel"><div><div><ul><li><a href="#">Все дозировки</a></li>`)
+		for i := 0; i < f.dosages; i++ {
+			fmt.Fprintf(&page, `<li><a href="//tabletki.ua/dosage/%s-%d/">Drug</a></li>`, drug, i)
+		}
+		page.WriteString(`</ul></div></div></div>`)
+	default:
+		page.WriteString(`<div class="header-panel"><h1>Drug</h1></div>`)
+	}
+	page.WriteString("</body></html>")
+	doc, err := html.Parse(strings.NewReader(page.String()))
+	return doc, url, http.StatusOK, 0, err
+}
+
+// slowDrugStore stalls on every commit of batch drugs, like a database
+// under load
+type slowDrugStore struct {
+	commit time.Duration
+	batch  int
+}
+
+func (s slowDrugStore) Save(drugsChan <-chan Drug) (int, error) {
+	num := 0
+	for range drugsChan {
+		if num++; num%s.batch == 0 {
+			time.Sleep(s.commit)
+		}
+	}
+	return num, nil
+}
+
+func (s slowDrugStore) Close() {}
+
+// BenchmarkScanBuffer scans the made-up site into the slow store with
+// different --buffer sizes, 0 is the default of twice --workers
+func BenchmarkScanBuffer(b *testing.B) {
+	// The store keeps up with the workers on average, but not while
+	// it commits
+	site := siteFetcher{groups: 4, goods: 10, dosages: 5, latency: 4 * time.Millisecond}
+	drugs := site.groups * site.goods * site.dosages
+	store := slowDrugStore{commit: 5 * time.Millisecond, batch: 40}
+	for _, buffer := range []int{1, 10, 0, 200} {
+		b.Run(fmt.Sprintf("buffer-%d", buffer), func(b *testing.B) {
+			cnf := getConfig()
+			cnf.Fetcher = site
+			cnf.Buffer = buffer
+			cnf.CanaryURL = ""
+			for i := 0; i < b.N; i++ {
+				if err := scanDrugs(context.Background(), cnf, store); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(drugs*b.N)/b.Elapsed().Seconds(), "drugs/s")
+		})
+	}
+}
@@ -0,0 +1,77 @@
+//go:build integration
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestMySQLDrugStore saves the drugs to the MySQL (or MariaDB) database of
+// TABLETKI_TEST_MYSQL_DSN and reads them back. The Drugs table of the
+// database is replaced, so point it to a scratch database.
+func TestMySQLDrugStore(t *testing.T) {
+	dsn := os.Getenv("TABLETKI_TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("TABLETKI_TEST_MYSQL_DSN is not set")
+	}
+	cnf := getConfig()
+	cnf.MySQLDSN = dsn
+	cnf.BatchSize = 2
+
+	drugs := testDrugs(3)
+	drugs[0].Name = "Аспирин Кардіо 100 мг"
+	drugs[0].Manufacture = "Bayer AG, Німеччина"
+	drugs[0].Instruction = "Показання: біль і гарячка 🌡.\nСпосіб застосування: внутрішньо."
+	drugs[0].ATCCode = []ATCEntry{{Code: "B01AC06", Name: "Ацетилсаліцилова кислота"}}
+	drugs[1].Available = true
+
+	// The second run replaces the drugs of the first one
+	var store *mysqlDrugStore
+	for run := 0; run < 2; run++ {
+		if store != nil {
+			store.Close()
+		}
+		var err error
+		if store, err = newMySQLDrugStore(cnf); err != nil {
+			t.Fatal(err)
+		}
+		num, err := store.Save(drugsChan(drugs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if num != len(drugs) {
+			t.Fatalf("saved %d drugs, want %d", num, len(drugs))
+		}
+	}
+	defer store.Close()
+
+	rows, err := store.db.Query("SELECT Name, Link, Manufacture, ATCCode, Instruction, Available FROM Drugs ORDER BY Link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	num := 0
+	for ; rows.Next(); num++ {
+		var got Drug
+		var atcCodes string
+		if err := rows.Scan(&got.Name, &got.Link, &got.Manufacture, &atcCodes, &got.Instruction, &got.Available); err != nil {
+			t.Fatal(err)
+		}
+		if num >= len(drugs) {
+			continue
+		}
+		want := drugs[num]
+		if got.Name != want.Name || got.Link != want.Link || got.Manufacture != want.Manufacture ||
+			got.Instruction != want.Instruction || got.Available != want.Available ||
+			atcCodes != formatATCCodes(want.ATCCode) {
+			t.Errorf("row %d is %+v with ATC codes %q, want %+v", num, got, atcCodes, want)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if num != len(drugs) {
+		t.Errorf("table has %d drugs, want %d", num, len(drugs))
+	}
+}